@@ -0,0 +1,223 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/remeh/sizedwaitgroup"
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/fingerprintx/pkg/plugins"
+)
+
+const (
+	defaultMaxConcurrentPlugins = 10
+	defaultMaxConcurrentTargets = 10
+)
+
+// Config controls how a scan is carried out, e.g. timeouts, the fast/slow
+// lane tradeoff, and how connections are dialed.
+type Config struct {
+	DefaultTimeout time.Duration
+	FastMode       bool
+	UDP            bool
+	Verbose        bool
+	Proxy          string
+
+	// TLSFingerprint selects the ClientHello fingerprint presented on TCP-TLS
+	// dials. Supported values are "go" (the default Go crypto/tls
+	// ClientHello), "chrome", "firefox", "safari", "ios", "randomized", and
+	// "random-weighted" (picks a fingerprint per-connection from a weighted
+	// distribution of real-world browser shares). Empty means "go".
+	TLSFingerprint string
+
+	// MaxConcurrentPlugins bounds how many plugins run concurrently against
+	// a single target in the slow lane. Zero uses a default of 10.
+	MaxConcurrentPlugins int
+	// MaxConcurrentTargets bounds how many targets ScanTargetsContext scans
+	// at once. Zero uses a default of 10.
+	MaxConcurrentTargets int
+	// RatePerSecond caps the aggregate rate of new connection attempts
+	// across every target and plugin dialed through this Config. Zero means
+	// unlimited.
+	RatePerSecond float64
+
+	// Resolver selects how ResolveTarget looks up hostnames: empty or
+	// "system" for the OS resolver, "udp://host:port" for plain DNS,
+	// "dot://host:port" for DNS-over-TLS, or "https://host/path" for
+	// DNS-over-HTTPS (tunnelled through Proxy along with the rest of the
+	// scan).
+	Resolver string
+}
+
+func (c *Config) maxConcurrentPlugins() int {
+	if c.MaxConcurrentPlugins > 0 {
+		return c.MaxConcurrentPlugins
+	}
+	return defaultMaxConcurrentPlugins
+}
+
+func (c *Config) maxConcurrentTargets() int {
+	if c.MaxConcurrentTargets > 0 {
+		return c.MaxConcurrentTargets
+	}
+	return defaultMaxConcurrentTargets
+}
+
+// limiterCache holds the *rate.Limiter for each Config that has one, keyed
+// by address so Config itself stays a plain, copyable value (no embedded
+// lock to trip go vet's copylocks check). limiterCacheMu guards both the
+// map read in limiter() and the reset in ResetLimiters, since replacing the
+// map wholesale (as opposed to deleting its keys) isn't safe to do through
+// sync.Map's own API.
+//
+// Each distinct *Config address that ever calls limiter() with
+// RatePerSecond set keeps its entry here for the life of the process -
+// nothing but ResetLimiters evicts it. Methods called on one *Config share
+// one entry. ScanTargets and ScanTargetsContext take their Config by value,
+// so each call adds one entry for its own copy: the targets of one call
+// share a limiter, separate calls do not, and the cache grows by one entry
+// per call until ResetLimiters is called.
+var (
+	limiterCacheMu sync.Mutex
+	limiterCache   = map[*Config]*rate.Limiter{}
+)
+
+// ResetLimiters discards every cached rate limiter, freeing limiterCache's
+// entries. Safe to call at any time, including while scans are in flight:
+// any dial already holding a *rate.Limiter keeps using it, and the next
+// call to limiter() for that Config allocates a fresh one (with a fresh
+// burst budget). See limiterCache's doc for when this is needed.
+func ResetLimiters() {
+	limiterCacheMu.Lock()
+	defer limiterCacheMu.Unlock()
+	limiterCache = map[*Config]*rate.Limiter{}
+}
+
+// limiter returns c's shared rate.Limiter, creating it on first use. Returns
+// nil when RatePerSecond is unset, meaning "unlimited".
+func (c *Config) limiter() *rate.Limiter {
+	if c.RatePerSecond <= 0 {
+		return nil
+	}
+	limiterCacheMu.Lock()
+	defer limiterCacheMu.Unlock()
+	if limiter, ok := limiterCache[c]; ok {
+		return limiter
+	}
+	burst := int(c.RatePerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	limiter := rate.NewLimiter(rate.Limit(c.RatePerSecond), burst)
+	limiterCache[c] = limiter
+	return limiter
+}
+
+type proxyKey struct{}
+
+// withProxy attaches proxy (a Config's Proxy chain) to ctx, so every dial
+// made while scanning a target uses this specific chain instead of the
+// shared Socks5Proxy package variable - which two concurrent
+// ScanTargetsContext calls with different Config.Proxy values would
+// otherwise race on.
+func withProxy(ctx context.Context, proxy string) context.Context {
+	return context.WithValue(ctx, proxyKey{}, proxy)
+}
+
+// proxyFromContext returns the proxy chain attached to ctx by withProxy, or
+// falls back to the package-level Socks5Proxy for callers that set it
+// directly instead of going through a Config (e.g. a bare call to
+// DialTCPOverSocks5 with no context).
+func proxyFromContext(ctx context.Context) string {
+	if proxy, ok := ctx.Value(proxyKey{}).(string); ok {
+		return proxy
+	}
+	return Socks5Proxy
+}
+
+type rateLimiterKey struct{}
+
+// withRateLimiter attaches limiter to ctx so every DialContext call made
+// while scanning a target shares the same budget. A nil limiter is a no-op.
+func withRateLimiter(ctx context.Context, limiter *rate.Limiter) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, rateLimiterKey{}, limiter)
+}
+
+// waitRateLimit blocks until ctx's rate limiter (if any) admits one more
+// connection attempt, or returns early if ctx is done.
+func waitRateLimit(ctx context.Context) error {
+	if limiter, ok := ctx.Value(rateLimiterKey{}).(*rate.Limiter); ok {
+		return limiter.Wait(ctx)
+	}
+	return nil
+}
+
+// ScanTargets runs config against every target using context.Background().
+// See ScanTargetsContext.
+func ScanTargets(targets []plugins.Target, config Config) ([]*plugins.Service, error) {
+	return ScanTargetsContext(context.Background(), targets, config)
+}
+
+// ScanTargetsContext runs config against every target, returning the
+// services that were identified. Up to config.MaxConcurrentTargets targets
+// are scanned concurrently, and ctx cancellation stops any target scan that
+// hasn't started yet as well as every one already in flight.
+func ScanTargetsContext(ctx context.Context, targets []plugins.Target, config Config) ([]*plugins.Service, error) {
+	var (
+		mutex   sync.Mutex
+		results = make([]*plugins.Service, 0, len(targets))
+		scanErr error
+	)
+
+	sw := sizedwaitgroup.New(config.maxConcurrentTargets())
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		sw.Add()
+		go func(target plugins.Target) {
+			defer sw.Done()
+
+			var (
+				result *plugins.Service
+				err    error
+			)
+			if config.UDP {
+				result, err = config.UDPScanTargetContext(ctx, target)
+			} else {
+				result, err = config.SimpleScanTargetContext(ctx, target)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				scanErr = err
+				return
+			}
+			if result != nil {
+				results = append(results, result)
+			}
+		}(target)
+	}
+	sw.Wait()
+	return results, scanErr
+}
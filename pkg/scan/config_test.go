@@ -0,0 +1,141 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestMaxConcurrentPlugins(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want int
+	}{
+		{"unset uses default", Config{}, defaultMaxConcurrentPlugins},
+		{"zero uses default", Config{MaxConcurrentPlugins: 0}, defaultMaxConcurrentPlugins},
+		{"negative uses default", Config{MaxConcurrentPlugins: -1}, defaultMaxConcurrentPlugins},
+		{"explicit value", Config{MaxConcurrentPlugins: 3}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.maxConcurrentPlugins(); got != tt.want {
+				t.Errorf("maxConcurrentPlugins() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want int
+	}{
+		{"unset uses default", Config{}, defaultMaxConcurrentTargets},
+		{"zero uses default", Config{MaxConcurrentTargets: 0}, defaultMaxConcurrentTargets},
+		{"negative uses default", Config{MaxConcurrentTargets: -1}, defaultMaxConcurrentTargets},
+		{"explicit value", Config{MaxConcurrentTargets: 7}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.maxConcurrentTargets(); got != tt.want {
+				t.Errorf("maxConcurrentTargets() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigLimiter(t *testing.T) {
+	ResetLimiters()
+	defer ResetLimiters()
+
+	unlimited := &Config{}
+	if l := unlimited.limiter(); l != nil {
+		t.Errorf("limiter() for RatePerSecond <= 0 = %v, want nil", l)
+	}
+
+	limited := &Config{RatePerSecond: 5}
+	first := limited.limiter()
+	if first == nil {
+		t.Fatal("limiter() for RatePerSecond > 0 = nil, want non-nil")
+	}
+	if second := limited.limiter(); second != first {
+		t.Error("limiter() returned a different *rate.Limiter on the second call for the same Config")
+	}
+
+	other := &Config{RatePerSecond: 5}
+	if otherLimiter := other.limiter(); otherLimiter == first {
+		t.Error("limiter() shared a *rate.Limiter between two distinct Configs")
+	}
+}
+
+// TestResetLimitersConcurrent exercises ResetLimiters racing against
+// limiter() the way a long-running server calling ResetLimiters
+// periodically would, while scans are still in flight. Run with -race.
+func TestResetLimitersConcurrent(t *testing.T) {
+	defer ResetLimiters()
+	cfg := &Config{RatePerSecond: 5}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cfg.limiter()
+		}()
+		go func() {
+			defer wg.Done()
+			ResetLimiters()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWithProxyAndProxyFromContext(t *testing.T) {
+	old := Socks5Proxy
+	defer func() { Socks5Proxy = old }()
+
+	Socks5Proxy = "socks5://fallback:1080"
+	if got := proxyFromContext(context.Background()); got != Socks5Proxy {
+		t.Errorf("proxyFromContext(no value) = %q, want fallback %q", got, Socks5Proxy)
+	}
+
+	ctx := withProxy(context.Background(), "socks5://explicit:1080")
+	if got := proxyFromContext(ctx); got != "socks5://explicit:1080" {
+		t.Errorf("proxyFromContext(withProxy) = %q, want %q", got, "socks5://explicit:1080")
+	}
+}
+
+func TestWaitRateLimitNoLimiter(t *testing.T) {
+	if err := waitRateLimit(context.Background()); err != nil {
+		t.Errorf("waitRateLimit(no limiter) error = %v, want nil", err)
+	}
+}
+
+func TestWaitRateLimitCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cfg := &Config{RatePerSecond: 0.001}
+	ctx = withRateLimiter(ctx, cfg.limiter())
+	defer ResetLimiters()
+
+	if err := waitRateLimit(ctx); err == nil {
+		t.Error("waitRateLimit(cancelled ctx, limiter set) error = nil, want non-nil")
+	}
+}
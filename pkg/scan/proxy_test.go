@@ -0,0 +1,120 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBuildSocks4aRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		port   uint16
+		userID string
+		want   []byte
+	}{
+		{
+			name: "no userid",
+			host: "example.com",
+			port: 443,
+			want: []byte{0x04, 0x01, 0x01, 0xbb, 0, 0, 0, 1, 0x00, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00},
+		},
+		{
+			name:   "with userid",
+			host:   "internal",
+			port:   80,
+			userID: "alice",
+			want:   []byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1, 'a', 'l', 'i', 'c', 'e', 0x00, 'i', 'n', 't', 'e', 'r', 'n', 'a', 'l', 0x00},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildSocks4aRequest(tt.host, tt.port, tt.userID)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("buildSocks4aRequest(%q, %d, %q) = %x, want %x", tt.host, tt.port, tt.userID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildHTTPConnectRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     string
+		auth     string
+		wantHas  []string
+		wantMiss []string
+	}{
+		{
+			name:    "no auth",
+			addr:    "example.com:443",
+			wantHas: []string{"CONNECT example.com:443 HTTP/1.1\r\n", "Host: example.com:443\r\n", "\r\n\r\n"},
+			wantMiss: []string{
+				"Proxy-Authorization",
+			},
+		},
+		{
+			name:    "with auth",
+			addr:    "example.com:443",
+			auth:    "dXNlcjpwYXNz",
+			wantHas: []string{"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(buildHTTPConnectRequest(tt.addr, tt.auth))
+			for _, want := range tt.wantHas {
+				if !strings.Contains(got, want) {
+					t.Errorf("buildHTTPConnectRequest(%q, %q) = %q, want substring %q", tt.addr, tt.auth, got, want)
+				}
+			}
+			for _, miss := range tt.wantMiss {
+				if strings.Contains(got, miss) {
+					t.Errorf("buildHTTPConnectRequest(%q, %q) = %q, want no substring %q", tt.addr, tt.auth, got, miss)
+				}
+			}
+		})
+	}
+}
+
+func TestDialUDPContextRejectsNonSocks5Proxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   string
+		wantErr bool
+	}{
+		{"no proxy configured", "", false},
+		{"socks5 proxy", "socks5://127.0.0.1:1080", false},
+		{"socks5h proxy", "socks5h://127.0.0.1:1080", false},
+		{"socks4a proxy", "socks4a://127.0.0.1:1080", true},
+		{"http connect proxy", "http://127.0.0.1:8080", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := withProxy(context.Background(), tt.proxy)
+			_, err := DialUDPContext(ctx, "198.51.100.1", 53)
+			if tt.wantErr && err == nil {
+				t.Fatalf("DialUDPContext() with proxy %q: error = nil, want non-nil (SOCKS4a/HTTP CONNECT can't relay UDP)", tt.proxy)
+			}
+			if !tt.wantErr && err != nil && strings.Contains(err.Error(), "cannot route UDP through proxy") {
+				t.Errorf("DialUDPContext() with proxy %q: unexpected proxy-routing error = %v", tt.proxy, err)
+			}
+		})
+	}
+}
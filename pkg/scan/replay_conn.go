@@ -0,0 +1,43 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// replayConn presents a byte slice already captured from a live flow as a
+// net.Conn, so a plugin's read-based fingerprinting logic can run against it
+// without a real peer to write probes to or close out from under the flow it
+// was captured from. Used by IdentifyData/IdentifyUDPData.
+type replayConn struct {
+	r *bytes.Reader
+}
+
+func newReplayConn(data []byte) *replayConn {
+	return &replayConn{r: bytes.NewReader(data)}
+}
+
+func (c *replayConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *replayConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *replayConn) Close() error                { return nil }
+func (c *replayConn) LocalAddr() net.Addr         { return nil }
+func (c *replayConn) RemoteAddr() net.Addr        { return nil }
+
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,309 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/praetorian-inc/fingerprintx/pkg/plugins"
+)
+
+// Resolver looks up the addresses for a hostname. Config.Resolver selects
+// which implementation ResolveTarget uses.
+type Resolver interface {
+	Resolve(host string) ([]netip.Addr, error)
+}
+
+// ResolveTarget resolves host to its addresses using c.Resolver, which may
+// be empty/"system" (the OS resolver), "udp://host:port", "dot://host:port"
+// (DNS-over-TLS), or "https://host/path" (DNS-over-HTTPS, routed through
+// c.Proxy same as the scan itself). If host is already an address, it's
+// returned unchanged without consulting any resolver.
+func (c *Config) ResolveTarget(host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	resolver, err := newResolver(c.Resolver, c.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return resolver.Resolve(host)
+}
+
+// ScanHost resolves host via c.ResolveTarget and scans the result using
+// context.Background(). See ScanHostContext.
+func (c *Config) ScanHost(host string, port uint16) (*plugins.Service, error) {
+	return c.ScanHostContext(context.Background(), host, port)
+}
+
+// ScanHostContext is the hostname-aware counterpart to SimpleScanTargetContext
+// / UDPScanTargetContext: it resolves host through c.Resolver (so the lookup
+// itself can be routed away from the OS resolver, e.g. over c.Proxy via DoH)
+// before dialing, instead of requiring the caller to have resolved host into
+// a plugins.Target.Address already.
+func (c *Config) ScanHostContext(ctx context.Context, host string, port uint16) (*plugins.Service, error) {
+	addrs, err := c.ResolveTarget(host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %q, err = %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+
+	target := plugins.Target{
+		Address: netip.AddrPortFrom(addrs[0], port),
+		Host:    host,
+	}
+	if c.UDP {
+		return c.UDPScanTargetContext(ctx, target)
+	}
+	return c.SimpleScanTargetContext(ctx, target)
+}
+
+// newResolver builds the Resolver configured by raw. proxyChain is only
+// used by the DoH resolver, so its lookups tunnel through the same SOCKS5
+// chain as the scan instead of leaking queries to the OS resolver.
+func newResolver(raw string, proxyChain string) (Resolver, error) {
+	if raw == "" || strings.EqualFold(raw, "system") {
+		return systemResolver{}, nil
+	}
+
+	uri, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver url %q, err = %w", raw, err)
+	}
+
+	switch strings.ToLower(uri.Scheme) {
+	case "udp":
+		return &udpResolver{addr: uri.Host}, nil
+	case "dot", "tls":
+		return &dotResolver{addr: uri.Host}, nil
+	case "https", "doh":
+		return &dohResolver{endpoint: raw, proxyChain: proxyChain}, nil
+	default:
+		return nil, fmt.Errorf("unsupported resolver scheme %q", uri.Scheme)
+	}
+}
+
+// systemResolver defers to the OS resolver (the fingerprintx default prior
+// to ResolveTarget existing).
+type systemResolver struct{}
+
+func (systemResolver) Resolve(host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+}
+
+// resolverCacheEntry is a cached answer, valid until expires.
+type resolverCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// resolverCache caches answers across resolvers, keyed by "<resolver-addr>|<host>".
+var resolverCache sync.Map // map[string]resolverCacheEntry
+
+func cachedResolve(cacheKey, host string, lookup func() ([]netip.Addr, time.Duration, error)) ([]netip.Addr, error) {
+	key := cacheKey + "|" + host
+	if v, ok := resolverCache.Load(key); ok {
+		entry := v.(resolverCacheEntry)
+		if time.Now().Before(entry.expires) {
+			return entry.addrs, nil
+		}
+		resolverCache.Delete(key)
+	}
+
+	addrs, ttl, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		resolverCache.Store(key, resolverCacheEntry{addrs: addrs, expires: time.Now().Add(ttl)})
+	}
+	return addrs, nil
+}
+
+// udpResolver queries a plain DNS server over UDP.
+type udpResolver struct {
+	addr string
+}
+
+func (r *udpResolver) Resolve(host string) ([]netip.Addr, error) {
+	return cachedResolve("udp://"+r.addr, host, func() ([]netip.Addr, time.Duration, error) {
+		conn, err := net.DialTimeout("udp", r.addr, 2*time.Second)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to reach resolver, err = %w", err)
+		}
+		defer conn.Close()
+
+		return queryBoth(host, func(query []byte) ([]byte, error) {
+			if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write(query); err != nil {
+				return nil, err
+			}
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			return buf[:n], nil
+		})
+	})
+}
+
+// dotResolver queries a DNS-over-TLS server (RFC 7858): same length-prefixed
+// message framing as DNS-over-TCP, wrapped in a TLS session.
+type dotResolver struct {
+	addr string
+}
+
+func (r *dotResolver) Resolve(host string) ([]netip.Addr, error) {
+	return cachedResolve("dot://"+r.addr, host, func() ([]netip.Addr, time.Duration, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", r.addr, &tls.Config{MinVersion: tls.VersionTLS12})
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to reach resolver, err = %w", err)
+		}
+		defer conn.Close()
+
+		return queryBoth(host, func(query []byte) ([]byte, error) {
+			if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				return nil, err
+			}
+			if err := writeDNSOverStream(conn, query); err != nil {
+				return nil, err
+			}
+			return readDNSOverStream(conn)
+		})
+	})
+}
+
+// queryBoth issues an A and an AAAA query via send, merging the resulting
+// addresses and returning the shorter of the two TTLs.
+func queryBoth(host string, send func(query []byte) ([]byte, error)) ([]netip.Addr, time.Duration, error) {
+	var (
+		addrs  []netip.Addr
+		minTTL time.Duration
+	)
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		query, err := buildDNSQuery(host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		raw, err := send(query)
+		if err != nil {
+			return nil, 0, fmt.Errorf("dns query failed, err = %w", err)
+		}
+		got, ttl, err := parseDNSAnswer(raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs = append(addrs, got...)
+		if i == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	return addrs, minTTL, nil
+}
+
+// buildDNSQuery packs a single-question DNS query message in wire format.
+func buildDNSQuery(host string, qtype dnsmessage.Type) ([]byte, error) {
+	name, err := dnsmessage.NewName(fqdn(host))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hostname %q, err = %w", host, err)
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return msg.Pack()
+}
+
+// parseDNSAnswer unpacks a DNS response and returns its A/AAAA addresses
+// along with the minimum TTL among them.
+func parseDNSAnswer(raw []byte) ([]netip.Addr, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(raw); err != nil {
+		return nil, 0, fmt.Errorf("malformed dns response, err = %w", err)
+	}
+
+	var (
+		addrs  []netip.Addr
+		minTTL uint32 = ^uint32(0)
+	)
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+		default:
+			continue
+		}
+		if answer.Header.TTL < minTTL {
+			minTTL = answer.Header.TTL
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, nil
+	}
+	return addrs, time.Duration(minTTL) * time.Second, nil
+}
+
+func fqdn(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+// writeDNSOverStream frames msg with the 2-byte length prefix used by
+// DNS-over-TCP and DNS-over-TLS (RFC 1035 section 4.2.2).
+func writeDNSOverStream(conn net.Conn, msg []byte) error {
+	prefix := []byte{byte(len(msg) >> 8), byte(len(msg))}
+	_, err := conn.Write(append(prefix, msg...))
+	return err
+}
+
+func readDNSOverStream(conn net.Conn) ([]byte, error) {
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, err
+	}
+	size := int(prefix[0])<<8 | int(prefix[1])
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
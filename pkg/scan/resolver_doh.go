@@ -0,0 +1,91 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// dohResolver queries a DNS-over-HTTPS endpoint using the wire format POST
+// described in RFC 8484, over an HTTP/2 client that dials through the same
+// proxy chain as the rest of the scan.
+type dohResolver struct {
+	endpoint   string
+	proxyChain string
+}
+
+func (r *dohResolver) Resolve(host string) ([]netip.Addr, error) {
+	return cachedResolve("doh://"+r.endpoint, host, func() ([]netip.Addr, time.Duration, error) {
+		client, err := newDoHClient(r.proxyChain)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return queryBoth(host, func(query []byte) ([]byte, error) {
+			return r.post(client, query)
+		})
+	})
+}
+
+func (r *dohResolver) post(client *http.Client, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, r.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh query rejected, status = %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// newDoHClient builds an HTTP/2 client whose connections are dialed through
+// proxyChain (the same SOCKS5/SOCKS4a/HTTP-CONNECT chain used for the scan
+// itself), so DoH lookups don't leak outside the tunnel.
+func newDoHClient(proxyChain string) (*http.Client, error) {
+	forward := &net.Dialer{Timeout: 2 * time.Second}
+	proxyDialer, err := NewProxyChain(proxyChain, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, proxyDialer, network, addr)
+		},
+	}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, fmt.Errorf("unable to configure http2 transport, err = %w", err)
+	}
+
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}, nil
+}
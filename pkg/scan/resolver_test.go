@@ -0,0 +1,130 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestBuildDNSQueryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		host  string
+		qtype dnsmessage.Type
+	}{
+		{"a record, bare host", "example.com", dnsmessage.TypeA},
+		{"aaaa record, fqdn host", "example.com.", dnsmessage.TypeAAAA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := buildDNSQuery(tt.host, tt.qtype)
+			if err != nil {
+				t.Fatalf("buildDNSQuery(%q, %v) error = %v", tt.host, tt.qtype, err)
+			}
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(query); err != nil {
+				t.Fatalf("unpacking built query: %v", err)
+			}
+			if len(msg.Questions) != 1 {
+				t.Fatalf("got %d questions, want 1", len(msg.Questions))
+			}
+			if msg.Questions[0].Type != tt.qtype {
+				t.Errorf("question type = %v, want %v", msg.Questions[0].Type, tt.qtype)
+			}
+			if got, want := msg.Questions[0].Name.String(), fqdn(tt.host); got != want {
+				t.Errorf("question name = %q, want %q", got, want)
+			}
+			if !msg.Header.RecursionDesired {
+				t.Error("RecursionDesired = false, want true")
+			}
+		})
+	}
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	name, err := dnsmessage.NewName("example.com.")
+	if err != nil {
+		t.Fatalf("dnsmessage.NewName() error = %v", err)
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+			},
+		},
+	}
+	raw, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("packing test message: %v", err)
+	}
+
+	addrs, ttl, err := parseDNSAnswer(raw)
+	if err != nil {
+		t.Fatalf("parseDNSAnswer() error = %v", err)
+	}
+	if ttl != 60*time.Second {
+		t.Errorf("ttl = %v, want %v (the minimum of the two answers)", ttl, 60*time.Second)
+	}
+
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	if len(addrs) != len(want) {
+		t.Fatalf("got %d addrs, want %d", len(addrs), len(want))
+	}
+	for i, addr := range addrs {
+		if addr != want[i] {
+			t.Errorf("addrs[%d] = %v, want %v", i, addr, want[i])
+		}
+	}
+}
+
+func TestParseDNSAnswerNoRecords(t *testing.T) {
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true}}
+	raw, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("packing test message: %v", err)
+	}
+
+	addrs, ttl, err := parseDNSAnswer(raw)
+	if err != nil {
+		t.Fatalf("parseDNSAnswer() error = %v", err)
+	}
+	if addrs != nil || ttl != 0 {
+		t.Errorf("parseDNSAnswer() = %v, %v, want nil, 0", addrs, ttl)
+	}
+}
+
+func TestFQDN(t *testing.T) {
+	tests := map[string]string{
+		"example.com":  "example.com.",
+		"example.com.": "example.com.",
+	}
+	for in, want := range tests {
+		if got := fqdn(in); got != want {
+			t.Errorf("fqdn(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -15,13 +15,12 @@
 package scan
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/remeh/sizedwaitgroup"
-	"golang.org/x/net/proxy"
 	"log"
 	"net"
-	"net/url"
 	"sort"
 	"strings"
 	"sync"
@@ -74,18 +73,33 @@ func setupPlugins() {
 	})
 }
 
-// UDP Scan of the target
+// UDPScanTarget scans target over UDP using context.Background(). See
+// UDPScanTargetContext.
 func (c *Config) UDPScanTarget(target plugins.Target) (*plugins.Service, error) {
+	return c.UDPScanTargetContext(context.Background(), target)
+}
+
+// UDPScanTargetContext is UDPScanTarget with explicit cancellation: ctx is
+// checked before every dial, and cancelling it closes the connection of a
+// plugin already in flight, so the scan stops without waiting for that
+// plugin to finish on its own.
+func (c *Config) UDPScanTargetContext(ctx context.Context, target plugins.Target) (*plugins.Service, error) {
+	ctx = withRateLimiter(ctx, c.limiter())
+	ctx = withProxy(ctx, c.Proxy)
+
 	// first check the default port mappings for TCP / TLS
 	for _, plugin := range sortedUDPPlugins {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		ip := target.Address.Addr().String()
 		port := target.Address.Port()
 		if plugin.PortPriority(port) {
-			conn, err := DialUDP(ip, port)
+			conn, err := DialUDPContext(ctx, ip, port)
 			if err != nil {
 				return nil, fmt.Errorf("unable to connect, err = %w", err)
 			}
-			result, err := simplePluginRunner(conn, target, c, plugin)
+			result, err := simplePluginRunner(ctx, conn, target, c, plugin)
 			if err != nil && c.Verbose {
 				log.Printf("error: %v scanning %v\n", err, target.Address.String())
 			}
@@ -101,11 +115,14 @@ func (c *Config) UDPScanTarget(target plugins.Target) (*plugins.Service, error)
 	}
 
 	for _, plugin := range sortedUDPPlugins {
-		conn, err := DialUDP(target.Address.Addr().String(), target.Address.Port())
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		conn, err := DialUDPContext(ctx, target.Address.Addr().String(), target.Address.Port())
 		if err != nil {
 			return nil, fmt.Errorf("unable to connect, err = %w", err)
 		}
-		result, err := simplePluginRunner(conn, target, c, plugin)
+		result, err := simplePluginRunner(ctx, conn, target, c, plugin)
 		if result != nil && err == nil {
 			return result, nil
 		}
@@ -113,25 +130,39 @@ func (c *Config) UDPScanTarget(target plugins.Target) (*plugins.Service, error)
 	return nil, nil
 }
 
-// simpleScanTarget attempts to identify the service that is running on a given
-// port. The fingerprinter supports two modes of operation referred to as the
-// fast lane and slow lane. The fast lane aims to be as fast as possible and
-// only attempts to fingerprint services by mapping them to their default port.
-// The slow lane isn't as focused on performance and instead tries to be as
-// accurate as possible.
+// SimpleScanTarget scans target using context.Background(). See
+// SimpleScanTargetContext.
 func (c *Config) SimpleScanTarget(target plugins.Target) (*plugins.Service, error) {
+	return c.SimpleScanTargetContext(context.Background(), target)
+}
+
+// SimpleScanTargetContext attempts to identify the service that is running
+// on a given port. The fingerprinter supports two modes of operation
+// referred to as the fast lane and slow lane. The fast lane aims to be as
+// fast as possible and only attempts to fingerprint services by mapping
+// them to their default port. The slow lane isn't as focused on performance
+// and instead tries to be as accurate as possible.
+//
+// ctx bounds the whole scan: it's checked before every dial in the fast
+// lane, and in the slow lane it's cancelled as soon as one plugin matches so
+// every other in-flight dial/plugin for this target stops immediately.
+func (c *Config) SimpleScanTargetContext(ctx context.Context, target plugins.Target) (*plugins.Service, error) {
+	ctx = withRateLimiter(ctx, c.limiter())
+	ctx = withProxy(ctx, c.Proxy)
 	ip := target.Address.Addr().String()
 	port := target.Address.Port()
 
 	// first check the default port mappings for TCP / TLS
 	for _, plugin := range sortedTCPPlugins {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if plugin.PortPriority(port) {
-			//conn, err := DialTCP(ip, port)
-			conn, err := DialTCPOverSocks5(ip, port)
+			conn, err := DialTCPOverSocks5Context(ctx, ip, port)
 			if err != nil {
 				return nil, fmt.Errorf("unable to connect, err = %w", err)
 			}
-			result, err := simplePluginRunner(conn, target, c, plugin)
+			result, err := simplePluginRunner(ctx, conn, target, c, plugin)
 			if err != nil && c.Verbose {
 				log.Printf("error: %v scanning %v\n", err, target.Address.String())
 			}
@@ -141,13 +172,31 @@ func (c *Config) SimpleScanTarget(target plugins.Target) (*plugins.Service, erro
 		}
 	}
 
-	//tlsConn, tlsErr := DialTLS(target)
-	tlsConn, tlsErr := DialTLSOverSocks5(target)
+	// One handshake, advertising every TLS plugin's ALPN protos, lets us
+	// dispatch straight to the plugin matching the negotiated protocol
+	// instead of redialing TLS for each candidate in turn.
+	tlsConn, tlsErr := DialTLSOverSocks5ContextALPN(ctx, target, c.TLSFingerprint, advertisedALPNProtos(sortedTCPTLSPlugins))
 	isTLS := tlsErr == nil
+	if isTLS {
+		if plugin := dispatchALPNPlugin(sortedTCPTLSPlugins, tlsNegotiatedALPN(tlsConn)); plugin != nil {
+			result, err := simplePluginRunner(ctx, tlsConn, target, c, plugin)
+			if err != nil && c.Verbose {
+				log.Printf("error: %v scanning %v\n", err, target.Address.String())
+			}
+			if result != nil && err == nil {
+				return result, nil
+			}
+			tlsConn, tlsErr = DialTLSOverSocks5Context(ctx, target, c.TLSFingerprint)
+			isTLS = tlsErr == nil
+		}
+	}
+
+	// fall back to the exhaustive by-port-priority loop, same as before ALPN
+	// dispatch existed
 	if isTLS {
 		for _, plugin := range sortedTCPTLSPlugins {
 			if plugin.PortPriority(port) {
-				result, err := simplePluginRunner(tlsConn, target, c, plugin)
+				result, err := simplePluginRunner(ctx, tlsConn, target, c, plugin)
 				if err != nil && c.Verbose {
 					log.Printf("error: %v scanning %v\n", err, target.Address.String())
 				}
@@ -155,8 +204,7 @@ func (c *Config) SimpleScanTarget(target plugins.Target) (*plugins.Service, erro
 					// identified plugin match
 					return result, nil
 				}
-				//tlsConn, err = DialTLS(target)
-				tlsConn, err = DialTLSOverSocks5(target)
+				tlsConn, err = DialTLSOverSocks5Context(ctx, target, c.TLSFingerprint)
 				if err != nil {
 					return nil, fmt.Errorf("error connecting via TLS, err = %w", err)
 				}
@@ -169,82 +217,149 @@ func (c *Config) SimpleScanTarget(target plugins.Target) (*plugins.Service, erro
 		return nil, nil
 	}
 
-	// go through each service mapping and check it
+	// go through each service mapping and check it, bounded by
+	// MaxConcurrentPlugins and cancelled the moment one matches
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var scanResults *plugins.Service
 	var scanErr error
-	sw := sizedwaitgroup.New(10)
+	sw := sizedwaitgroup.New(c.maxConcurrentPlugins())
 	mutex := &sync.Mutex{}
+
+	runPlugin := func(plugin plugins.Plugin, dial func() (net.Conn, error)) {
+		defer sw.Done()
+		conn, err := dial()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			mutex.Lock()
+			scanErr = fmt.Errorf("unable to connect, err = %w", err)
+			mutex.Unlock()
+			return
+		}
+		result, err := simplePluginRunner(ctx, conn, target, c, plugin)
+		if err != nil && c.Verbose {
+			log.Printf("error: %v scanning %v\n", err, target.Address.String())
+		}
+		if result != nil && err == nil {
+			// identified plugin match; stop every other in-flight plugin
+			mutex.Lock()
+			if scanResults == nil {
+				scanResults = result
+				cancel()
+			}
+			mutex.Unlock()
+		}
+	}
+
 	if isTLS {
 		for _, plugin := range sortedTCPTLSPlugins {
-			if scanResults != nil || scanErr != nil {
+			if ctx.Err() != nil {
 				break
 			}
 			sw.Add()
 			go func(plugin plugins.Plugin) {
-				defer sw.Done()
-				//tlsConn, err := DialTLS(target)
-				tlsConn, err := DialTLSOverSocks5(target)
-				if err != nil {
-					mutex.Lock()
-					scanErr = fmt.Errorf("unable to connect, err = %w", err)
-					mutex.Unlock()
-					return
-				}
-				result, err := simplePluginRunner(tlsConn, target, c, plugin)
-				if err != nil && c.Verbose {
-					log.Printf("error: %v scanning %v\n", err, target.Address.String())
-				}
-				if result != nil && err == nil {
-					// identified plugin match
-					mutex.Lock()
-					scanResults = result
-					mutex.Unlock()
-					return
-				}
+				runPlugin(plugin, func() (net.Conn, error) {
+					return DialTLSOverSocks5Context(ctx, target, c.TLSFingerprint)
+				})
 			}(plugin)
 		}
 	} else {
 		for _, plugin := range sortedTCPPlugins {
-			if scanResults != nil || scanErr != nil {
+			if ctx.Err() != nil {
 				break
 			}
 			sw.Add()
 			go func(plugin plugins.Plugin) {
-				defer sw.Done()
-				//conn, err := DialTCP(ip, port)
-				conn, err := DialTCPOverSocks5(ip, port)
-				if err != nil {
-					mutex.Lock()
-					scanErr = fmt.Errorf("unable to connect, err = %w", err)
-					mutex.Unlock()
-					return
-				}
-				result, err := simplePluginRunner(conn, target, c, plugin)
-				if err != nil && c.Verbose {
-					log.Printf("error: %v scanning %v\n", err, target.Address.String())
-				}
-				if result != nil && err == nil {
-					// identified plugin match
-					mutex.Lock()
-					scanResults = result
-					mutex.Unlock()
-					return
-				}
+				runPlugin(plugin, func() (net.Conn, error) {
+					return DialTCPOverSocks5Context(ctx, ip, port)
+				})
 			}(plugin)
 		}
 	}
 	sw.Wait()
-	return scanResults, scanErr
-	//return nil, nil
+	if scanResults != nil {
+		return scanResults, nil
+	}
+	return nil, scanErr
+}
+
+// IdentifyData runs the ordinary TCP scan plugins (not the TLS ones) against a captured
+// replay of data (bytes already seen on a live flow, e.g. by a passive
+// in-line forwarder like pkg/tun), instead of dialing a fresh connection to
+// target purely to fingerprint it. Each plugin gets its own fresh replay of
+// data, since a plugin's Run is expected to close the connection it's given.
+func (c *Config) IdentifyData(data []byte, target plugins.Target) (*plugins.Service, error) {
+	return c.IdentifyDataContext(context.Background(), data, target)
+}
+
+// IdentifyDataContext is IdentifyData with an explicit context.
+func (c *Config) IdentifyDataContext(ctx context.Context, data []byte, target plugins.Target) (*plugins.Service, error) {
+	ctx = withRateLimiter(ctx, c.limiter())
+	for _, plugin := range sortedTCPPlugins {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		result, err := simplePluginRunner(ctx, newReplayConn(data), target, c, plugin)
+		if err != nil && c.Verbose {
+			log.Printf("error: %v identifying %v\n", err, target.Address.String())
+		}
+		if result != nil && err == nil {
+			return result, nil
+		}
+	}
+	return nil, nil
+}
+
+// IdentifyUDPData is IdentifyData for the UDP plugins.
+func (c *Config) IdentifyUDPData(data []byte, target plugins.Target) (*plugins.Service, error) {
+	return c.IdentifyUDPDataContext(context.Background(), data, target)
+}
+
+// IdentifyUDPDataContext is IdentifyUDPData with an explicit context.
+func (c *Config) IdentifyUDPDataContext(ctx context.Context, data []byte, target plugins.Target) (*plugins.Service, error) {
+	ctx = withRateLimiter(ctx, c.limiter())
+	for _, plugin := range sortedUDPPlugins {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		result, err := simplePluginRunner(ctx, newReplayConn(data), target, c, plugin)
+		if err != nil && c.Verbose {
+			log.Printf("error: %v identifying %v\n", err, target.Address.String())
+		}
+		if result != nil && err == nil {
+			return result, nil
+		}
+	}
+	return nil, nil
 }
 
 // This will attempt to close the provided Conn after running the plugin.
 func simplePluginRunner(
+	ctx context.Context,
 	conn net.Conn,
 	target plugins.Target,
 	config *Config,
 	plugin plugins.Plugin,
 ) (*plugins.Service, error) {
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	// Close conn if ctx is cancelled while the plugin runs, so a plugin
+	// blocked on I/O returns instead of running to completion.
+	runDone := make(chan struct{})
+	defer close(runDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-runDone:
+		}
+	}()
+
 	// Log probe start.
 	if config.Verbose {
 		log.Printf("%v %v-> scanning %v\n",
@@ -268,101 +383,164 @@ func simplePluginRunner(
 	return result, err
 }
 
+// DialTLS dials target.Address over TCP-TLS using the default ("go")
+// ClientHello fingerprint. See DialTLSWithFingerprint to pick a different
+// one.
 func DialTLS(target plugins.Target) (net.Conn, error) {
-	config := &tlsConfig
-	if target.Host != "" {
-		// make a new config clone to add the custom host for each new tls connection
-		c := config.Clone()
-		c.ServerName = target.Host
-		config = c
+	return DialTLSWithFingerprint(target, "")
+}
+
+// DialTLSWithFingerprint is DialTLS with an explicit ClientHello fingerprint;
+// see Config.TLSFingerprint for supported values.
+func DialTLSWithFingerprint(target plugins.Target, fingerprint string) (net.Conn, error) {
+	return DialTLSContext(context.Background(), target, fingerprint)
+}
+
+// DialTLSContext is DialTLSWithFingerprint with a context threaded through
+// the underlying net.Dialer.DialContext.
+func DialTLSContext(ctx context.Context, target plugins.Target, fingerprint string) (net.Conn, error) {
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, err
 	}
 	var dialer = &net.Dialer{
 		Timeout: 2 * time.Second,
 	}
-	return tls.DialWithDialer(dialer, "tcp", target.Address.String(), config)
+	conn, err := dialer.DialContext(ctx, "tcp", target.Address.String())
+	if err != nil {
+		return nil, err
+	}
+	return tlsClientHello(conn, fingerprint, target.Host)
 }
 
 func DialTCP(ip string, port uint16) (net.Conn, error) {
+	return DialTCPContext(context.Background(), ip, port)
+}
+
+// DialTCPContext is DialTCP with a context threaded through the underlying
+// net.Dialer.DialContext.
+func DialTCPContext(ctx context.Context, ip string, port uint16) (net.Conn, error) {
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
 	var dialer = &net.Dialer{
 		Timeout: 2 * time.Second,
 	}
 	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
-	return dialer.Dial("tcp", addr)
+	return dialer.DialContext(ctx, "tcp", addr)
 }
 
+// DialUDP dials ip:port over UDP, routing through Socks5Proxy's first hop
+// via SOCKS5 UDP ASSOCIATE when one is configured. SOCKS4a and HTTP CONNECT
+// proxies have no UDP equivalent, so a chain starting with either of those
+// is an error rather than silently falling back to a direct, unproxied
+// dial.
 func DialUDP(ip string, port uint16) (net.Conn, error) {
+	return DialUDPContext(context.Background(), ip, port)
+}
+
+// DialUDPContext is DialUDP with a context threaded through the underlying
+// dial (and the SOCKS5 ASSOCIATE control connection, when used).
+func DialUDPContext(ctx context.Context, ip string, port uint16) (net.Conn, error) {
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+
+	if firstHop, ok := firstProxyHop(proxyFromContext(ctx)); ok {
+		if !strings.HasPrefix(strings.ToLower(firstHop), "socks5") {
+			return nil, fmt.Errorf("cannot route UDP through proxy %q: only SOCKS5 (via UDP ASSOCIATE) can relay UDP, not SOCKS4a or HTTP CONNECT", firstHop)
+		}
+		return dialSocks5UDPAssociate(ctx, firstHop, addr)
+	}
+
 	var dialer = &net.Dialer{
 		Timeout: 2 * time.Second,
 	}
-	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
-	return dialer.Dial("udp", addr)
+	return dialer.DialContext(ctx, "udp", addr)
+}
+
+// firstProxyHop returns the first proxy URL in a comma-separated chain.
+func firstProxyHop(chain string) (string, bool) {
+	for _, raw := range strings.Split(chain, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw != "" {
+			return raw, true
+		}
+	}
+	return "", false
 }
 
 func DialTCPOverSocks5(ip string, port uint16) (net.Conn, error) {
-	var conn net.Conn
+	return DialTCPOverSocks5Context(context.Background(), ip, port)
+}
+
+// DialTCPOverSocks5Context is DialTCPOverSocks5 with a context threaded
+// through the proxy dial.
+func DialTCPOverSocks5Context(ctx context.Context, ip string, port uint16) (net.Conn, error) {
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
 	var dialer = &net.Dialer{
 		Timeout: 2 * time.Second,
 	}
-	if Socks5Proxy == "" {
-		var err error
-		conn, err = DialTCP(ip, port)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		dialerSocks5, err := Socks5Dialer(dialer)
-		if err != nil {
-			return nil, err
-		}
-		conn, err = dialerSocks5.Dial("tcp", net.JoinHostPort(ip, fmt.Sprintf("%d", port)))
-		if err != nil {
-			return nil, err
-		}
-
+	dialerSocks5, err := Socks5Dialer(dialer, proxyFromContext(ctx))
+	if err != nil {
+		return nil, err
 	}
-	return conn, nil
+	return dialContext(ctx, dialerSocks5, "tcp", net.JoinHostPort(ip, fmt.Sprintf("%d", port)))
 }
 
+// DialTLSOverSocks5 is DialTLS, routed through Socks5Proxy when one is
+// configured.
 func DialTLSOverSocks5(target plugins.Target) (net.Conn, error) {
-	var conn net.Conn
+	return DialTLSOverSocks5WithFingerprint(target, "")
+}
+
+// DialTLSOverSocks5WithFingerprint is DialTLSOverSocks5 with an explicit
+// ClientHello fingerprint; see Config.TLSFingerprint for supported values.
+func DialTLSOverSocks5WithFingerprint(target plugins.Target, fingerprint string) (net.Conn, error) {
+	return DialTLSOverSocks5Context(context.Background(), target, fingerprint)
+}
+
+// DialTLSOverSocks5Context is DialTLSOverSocks5WithFingerprint with a
+// context threaded through the proxy dial.
+func DialTLSOverSocks5Context(ctx context.Context, target plugins.Target, fingerprint string) (net.Conn, error) {
+	return DialTLSOverSocks5ContextALPN(ctx, target, fingerprint, nil)
+}
+
+// DialTLSOverSocks5ContextALPN is DialTLSOverSocks5Context with an explicit
+// set of ALPN protocols to advertise, for the SNI/ALPN pre-dispatch
+// handshake in SimpleScanTargetContext.
+func DialTLSOverSocks5ContextALPN(ctx context.Context, target plugins.Target, fingerprint string, nextProtos []string) (net.Conn, error) {
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
 	var dialer = &net.Dialer{
 		Timeout: 2 * time.Second,
 	}
-	config := &tlsConfig
-	if target.Host != "" {
-		// make a new config clone to add the custom host for each new tls connection
-		c := config.Clone()
-		c.ServerName = target.Host
-		config = c
+	dialerSocks5, err := Socks5Dialer(dialer, proxyFromContext(ctx))
+	if err != nil {
+		return nil, err
 	}
-	if Socks5Proxy == "" {
-		return tls.DialWithDialer(dialer, "tcp", target.Address.String(), config)
-	} else {
-		dialerSocks5, err := Socks5Dialer(dialer)
-		if err != nil {
-			return nil, err
-		}
-		conn, err = dialerSocks5.Dial("tcp", target.Address.String())
-		if err != nil {
-			return nil, err
-		}
-		conn = tls.Client(conn, config)
-		return conn, nil
+	conn, err := dialContext(ctx, dialerSocks5, "tcp", target.Address.String())
+	if err != nil {
+		return nil, err
 	}
+	return tlsClientHelloALPN(conn, fingerprint, target.Host, nextProtos)
 }
 
-func Socks5Dialer(forward *net.Dialer) (proxy.Dialer, error) {
-	uri, err := url.Parse(Socks5Proxy)
-	if strings.ToLower(uri.Scheme) != "socks5" {
-		return nil, fmt.Errorf("%s", "Only support socks5")
-	}
-	if err != nil {
-		return nil, err
-	} else {
-		if dialerSocks5, err := proxy.FromURL(uri, forward); err != nil {
-			return nil, err
-		} else {
-			return dialerSocks5, nil
-		}
+// DialTarget dials target.Address over network ("tcp" or "udp"), honoring
+// c.Proxy and c.limiter(), for callers that hold a Config but aren't running
+// it through ScanTargetsContext - e.g. pkg/tun dialing a flow's real
+// destination for relay. TLS callers should use DialTLSOverSocks5Context
+// directly instead, since c.TLSFingerprint has no meaning for a bare dial.
+func (c *Config) DialTarget(ctx context.Context, network string, target plugins.Target) (net.Conn, error) {
+	ctx = withRateLimiter(ctx, c.limiter())
+	ctx = withProxy(ctx, c.Proxy)
+	ip := target.Address.Addr().String()
+	port := target.Address.Port()
+	if network == "udp" {
+		return DialUDPContext(ctx, ip, port)
 	}
+	return DialTCPOverSocks5Context(ctx, ip, port)
 }
@@ -0,0 +1,303 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialSocks5UDPAssociate performs a SOCKS5 UDP ASSOCIATE (RFC 1928 section 7)
+// against the proxy at socks5URL, keeping the TCP control connection alive
+// for as long as the UDP relay binding is needed, and returns a net.Conn
+// "connected" to target that tunnels every datagram through the relay.
+func dialSocks5UDPAssociate(ctx context.Context, socks5URL string, target string) (net.Conn, error) {
+	uri, err := url.Parse(socks5URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q, err = %w", socks5URL, err)
+	}
+
+	var dialer = &net.Dialer{Timeout: 2 * time.Second}
+	ctrl, err := dialer.DialContext(ctx, "tcp", uri.Host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach socks5 proxy, err = %w", err)
+	}
+
+	if err := socks5Handshake(ctrl, uri); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	relayAddr, err := socks5Associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	// Many SOCKS5 servers (ssh -D, Dante, ...) report BND.ADDR as 0.0.0.0/::
+	// to mean "same host as the control connection", not a literal address
+	// to dial.
+	if relayAddr.IP.IsUnspecified() {
+		if ctrlAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relayAddr.IP = ctrlAddr.IP
+		}
+	}
+
+	targetHost, targetPortStr, err := net.SplitHostPort(target)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("invalid target %q, err = %w", target, err)
+	}
+	targetPort, err := strconv.Atoi(targetPortStr)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("invalid target port %q, err = %w", targetPortStr, err)
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("unable to reach socks5 udp relay, err = %w", err)
+	}
+
+	return &socks5UDPConn{
+		udpConn:    udpConn,
+		ctrl:       ctrl,
+		targetHost: targetHost,
+		targetPort: uint16(targetPort),
+	}, nil
+}
+
+// socks5Handshake performs method negotiation, including the
+// username/password sub-negotiation (RFC 1929) when uri carries credentials.
+func socks5Handshake(conn net.Conn, uri *url.URL) error {
+	methods := []byte{0x00} // no auth
+	if uri.User != nil {
+		methods = []byte{0x02} // username/password
+	}
+	req := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5 greeting failed, err = %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks5 greeting response failed, err = %w", err)
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("not a socks5 proxy")
+	}
+
+	switch reply[1] {
+	case 0x00:
+		return nil
+	case 0x02:
+		return socks5Authenticate(conn, uri)
+	default:
+		return fmt.Errorf("socks5 proxy rejected all authentication methods")
+	}
+}
+
+func socks5Authenticate(conn net.Conn, uri *url.URL) error {
+	user := uri.User.Username()
+	pass, _ := uri.User.Password()
+	req := []byte{0x01, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks5 auth request failed, err = %w", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("socks5 auth response failed, err = %w", err)
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks5 authentication failed")
+	}
+	return nil
+}
+
+// socks5Associate sends a UDP ASSOCIATE request and returns the relay's UDP
+// endpoint advertised in the reply.
+func socks5Associate(conn net.Conn) (*net.UDPAddr, error) {
+	req := []byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0} // CMD=ASSOCIATE, ATYP=IPv4, DST=0.0.0.0:0
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("socks5 associate request failed, err = %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("socks5 associate response failed, err = %w", err)
+	}
+	if header[1] != 0x00 {
+		return nil, fmt.Errorf("socks5 associate rejected, code = %d", header[1])
+	}
+
+	return readSocks5UDPAddr(r, header[3])
+}
+
+func readSocks5UDPAddr(r *bufio.Reader, atyp byte) (*net.UDPAddr, error) {
+	var ip net.IP
+	switch atyp {
+	case 0x01:
+		buf := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		ip = net.IP(buf)
+	case 0x04:
+		buf := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		ip = net.IP(buf)
+	case 0x03:
+		lenByte, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, lenByte)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		resolved, err := net.ResolveIPAddr("ip", string(buf))
+		if err != nil {
+			return nil, err
+		}
+		ip = resolved.IP
+	default:
+		return nil, fmt.Errorf("unsupported socks5 address type %d", atyp)
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(portBuf))}, nil
+}
+
+// socks5UDPConn is a "connected" UDP net.Conn tunnelled through a SOCKS5 UDP
+// relay: every datagram is wrapped in the SOCKS5 UDP request header
+// (RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT) on write, and unwrapped on
+// read. The TCP control connection from the ASSOCIATE handshake is closed
+// alongside the UDP socket, since most SOCKS5 servers tear down the relay
+// binding as soon as it drops.
+type socks5UDPConn struct {
+	udpConn    *net.UDPConn
+	ctrl       net.Conn
+	targetHost string
+	targetPort uint16
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	header, err := socks5UDPHeader(c.targetHost, c.targetPort)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.udpConn.Write(append(header, b...))
+	if n > len(header) {
+		n -= len(header)
+	} else {
+		n = 0
+	}
+	return n, err
+}
+
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262) // header is at most 4 + 1 + 255 + 2 bytes (domain name form)
+	n, err := c.udpConn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := stripSocks5UDPHeader(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, payload), nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	udpErr := c.udpConn.Close()
+	ctrlErr := c.ctrl.Close()
+	if udpErr != nil {
+		return udpErr
+	}
+	return ctrlErr
+}
+
+func (c *socks5UDPConn) LocalAddr() net.Addr  { return c.udpConn.LocalAddr() }
+func (c *socks5UDPConn) RemoteAddr() net.Addr { return c.udpConn.RemoteAddr() }
+
+func (c *socks5UDPConn) SetDeadline(t time.Time) error      { return c.udpConn.SetDeadline(t) }
+func (c *socks5UDPConn) SetReadDeadline(t time.Time) error  { return c.udpConn.SetReadDeadline(t) }
+func (c *socks5UDPConn) SetWriteDeadline(t time.Time) error { return c.udpConn.SetWriteDeadline(t) }
+
+func socks5UDPHeader(host string, port uint16) ([]byte, error) {
+	header := []byte{0x00, 0x00, 0x00} // RSV(2) FRAG(1)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			header = append(header, 0x01)
+			header = append(header, ip4...)
+		} else {
+			header = append(header, 0x04)
+			header = append(header, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5 udp target host too long: %q", host)
+		}
+		header = append(header, 0x03, byte(len(host)))
+		header = append(header, host...)
+	}
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, port)
+	return append(header, portBuf...), nil
+}
+
+func stripSocks5UDPHeader(datagram []byte) ([]byte, error) {
+	if len(datagram) < 4 {
+		return nil, fmt.Errorf("short socks5 udp datagram")
+	}
+	atyp := datagram[3]
+	rest := datagram[4:]
+
+	var addrLen int
+	switch atyp {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		if len(rest) < 1 {
+			return nil, fmt.Errorf("short socks5 udp datagram")
+		}
+		addrLen = 1 + int(rest[0])
+	default:
+		return nil, fmt.Errorf("unsupported socks5 udp address type %d", atyp)
+	}
+
+	if len(rest) < addrLen+2 {
+		return nil, fmt.Errorf("short socks5 udp datagram")
+	}
+	return rest[addrLen+2:], nil
+}
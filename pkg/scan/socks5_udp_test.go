@@ -0,0 +1,71 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSocks5UDPHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		port uint16
+	}{
+		{"ipv4", "192.0.2.1", 53},
+		{"ipv6", "2001:db8::1", 8443},
+		{"domain", "example.com", 443},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := socks5UDPHeader(tt.host, tt.port)
+			if err != nil {
+				t.Fatalf("socks5UDPHeader(%q, %d) error = %v", tt.host, tt.port, err)
+			}
+
+			payload := []byte("hello")
+			datagram := append(header, payload...)
+
+			got, err := stripSocks5UDPHeader(datagram)
+			if err != nil {
+				t.Fatalf("stripSocks5UDPHeader() error = %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("stripSocks5UDPHeader() = %q, want %q", got, payload)
+			}
+		})
+	}
+}
+
+func TestSocks5UDPHeaderHostTooLong(t *testing.T) {
+	_, err := socks5UDPHeader(string(make([]byte, 256)), 53)
+	if err == nil {
+		t.Fatal("socks5UDPHeader() with a 256-byte host: want error, got nil")
+	}
+}
+
+func TestStripSocks5UDPHeaderShortDatagram(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0x00, 0x00, 0x00},
+		{0x00, 0x00, 0x00, 0x01, 1, 2, 3}, // ATYP=IPv4 but too few address bytes
+	}
+	for _, datagram := range tests {
+		if _, err := stripSocks5UDPHeader(datagram); err == nil {
+			t.Errorf("stripSocks5UDPHeader(%x): want error, got nil", datagram)
+		}
+	}
+}
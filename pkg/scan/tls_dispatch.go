@@ -0,0 +1,76 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import "github.com/praetorian-inc/fingerprintx/pkg/plugins"
+
+// ALPNAdvertiser is implemented by plugins.Plugin implementations that want
+// their protocol's ALPN identifiers (e.g. "h2", "postgresql") advertised on
+// the pre-dispatch TLS handshake, so that (1) servers that gate behavior on
+// ALPN see a realistic NextProtos list, and (2) the negotiated protocol can
+// be matched straight back to this plugin without redialing.
+//
+// No plugin in this tree implements ALPNAdvertiser yet - pkg/plugins is an
+// external dependency, not part of this module - so today
+// advertisedALPNProtos always returns an empty list and dispatchALPNPlugin
+// always returns nil: the pre-dispatch handshake still runs, but
+// SimpleScanTargetContext always falls through to the exhaustive
+// by-port-priority loop exactly as it did before this mechanism existed.
+// Wiring ALPNAdvertiser into the actual TLS plugins is the follow-up that
+// makes dispatch skip redials in practice.
+type ALPNAdvertiser interface {
+	ALPNProtos() []string
+}
+
+// advertisedALPNProtos collects the deduplicated union of every candidate's
+// ALPNAdvertiser protocols, to advertise on a single pre-dispatch handshake.
+func advertisedALPNProtos(candidates []plugins.Plugin) []string {
+	seen := make(map[string]bool)
+	var protos []string
+	for _, plugin := range candidates {
+		advertiser, ok := plugin.(ALPNAdvertiser)
+		if !ok {
+			continue
+		}
+		for _, proto := range advertiser.ALPNProtos() {
+			if !seen[proto] {
+				seen[proto] = true
+				protos = append(protos, proto)
+			}
+		}
+	}
+	return protos
+}
+
+// dispatchALPNPlugin returns the candidate whose ALPNProtos() contains
+// negotiatedALPN, or nil if none match (and the exhaustive loop over
+// candidates should run instead).
+func dispatchALPNPlugin(candidates []plugins.Plugin, negotiatedALPN string) plugins.Plugin {
+	if negotiatedALPN == "" {
+		return nil
+	}
+	for _, plugin := range candidates {
+		advertiser, ok := plugin.(ALPNAdvertiser)
+		if !ok {
+			continue
+		}
+		for _, proto := range advertiser.ALPNProtos() {
+			if proto == negotiatedALPN {
+				return plugin
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/fingerprintx/pkg/plugins"
+)
+
+// alpnPlugin is a minimal plugins.Plugin + ALPNAdvertiser, standing in for
+// the real plugin that would implement ALPNAdvertiser once one exists. It
+// proves advertisedALPNProtos/dispatchALPNPlugin do what their doc comments
+// promise, independent of pkg/plugins (an external dependency this tree
+// doesn't vendor) actually adopting the interface yet.
+type alpnPlugin struct {
+	name   string
+	protos []string
+}
+
+func (p alpnPlugin) Run(net.Conn, time.Duration, plugins.Target) (*plugins.Service, error) {
+	return nil, nil
+}
+func (p alpnPlugin) PortPriority(uint16) bool { return false }
+func (p alpnPlugin) Name() string             { return p.name }
+func (p alpnPlugin) Type() plugins.Protocol   { return plugins.TCPTLS }
+func (p alpnPlugin) Priority() int            { return 0 }
+func (p alpnPlugin) ALPNProtos() []string     { return p.protos }
+
+// plainPlugin is a plugins.Plugin that doesn't implement ALPNAdvertiser,
+// standing in for the rest of sortedTCPTLSPlugins today.
+type plainPlugin struct{ name string }
+
+func (p plainPlugin) Run(net.Conn, time.Duration, plugins.Target) (*plugins.Service, error) {
+	return nil, nil
+}
+func (p plainPlugin) PortPriority(uint16) bool { return false }
+func (p plainPlugin) Name() string             { return p.name }
+func (p plainPlugin) Type() plugins.Protocol   { return plugins.TCPTLS }
+func (p plainPlugin) Priority() int            { return 0 }
+
+func TestAdvertisedALPNProtos(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []plugins.Plugin
+		want       []string
+	}{
+		{"no candidates", nil, nil},
+		{"no ALPNAdvertiser candidates", []plugins.Plugin{plainPlugin{"plain"}}, nil},
+		{
+			name: "collects and dedups in encounter order",
+			candidates: []plugins.Plugin{
+				alpnPlugin{"h2", []string{"h2", "http/1.1"}},
+				plainPlugin{"plain"},
+				alpnPlugin{"pg", []string{"postgresql", "h2"}},
+			},
+			want: []string{"h2", "http/1.1", "postgresql"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := advertisedALPNProtos(tt.candidates)
+			if !equalStrings(got, tt.want) {
+				t.Errorf("advertisedALPNProtos(%v) = %v, want %v", tt.candidates, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatchALPNPlugin(t *testing.T) {
+	// Pointers, since alpnPlugin holds a slice and comparing two interface
+	// values of a non-comparable dynamic type panics.
+	h2 := &alpnPlugin{"h2", []string{"h2", "http/1.1"}}
+	pg := &alpnPlugin{"pg", []string{"postgresql"}}
+	plain := plainPlugin{"plain"}
+	candidates := []plugins.Plugin{h2, plain, pg}
+
+	tests := []struct {
+		name           string
+		negotiatedALPN string
+		want           plugins.Plugin
+	}{
+		{"empty negotiated proto", "", nil},
+		{"no candidate advertises it", "ftp", nil},
+		{"matches first candidate's proto", "h2", h2},
+		{"matches a later candidate's proto", "postgresql", pg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dispatchALPNPlugin(candidates, tt.negotiatedALPN)
+			if got != tt.want {
+				t.Errorf("dispatchALPNPlugin(candidates, %q) = %v, want %v", tt.negotiatedALPN, got, tt.want)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
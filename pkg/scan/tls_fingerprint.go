@@ -0,0 +1,135 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// weightedFingerprint is one entry in the random-weighted distribution used
+// by TLSFingerprint "random-weighted". Weight is relative, not a percentage.
+type weightedFingerprint struct {
+	name   string
+	id     utls.ClientHelloID
+	weight int
+}
+
+// weightedFingerprints approximates real-world browser market share so that
+// "random-weighted" scans look like ordinary browser traffic on aggregate.
+var weightedFingerprints = []weightedFingerprint{
+	{"chrome", utls.HelloChrome_Auto, 65},
+	{"firefox", utls.HelloFirefox_Auto, 15},
+	{"safari", utls.HelloSafari_Auto, 12},
+	{"ios", utls.HelloIOS_Auto, 8},
+}
+
+// clientHelloID resolves a TLSFingerprint config value to a uTLS
+// ClientHelloID. A zero ClientHelloID and ok=false means "use the Go
+// standard library's default ClientHello" (no uTLS involved).
+func clientHelloID(fingerprint string) (id utls.ClientHelloID, ok bool) {
+	switch strings.ToLower(fingerprint) {
+	case "", "go":
+		return utls.ClientHelloID{}, false
+	case "chrome":
+		return utls.HelloChrome_Auto, true
+	case "firefox":
+		return utls.HelloFirefox_Auto, true
+	case "safari":
+		return utls.HelloSafari_Auto, true
+	case "ios":
+		return utls.HelloIOS_Auto, true
+	case "randomized":
+		return utls.HelloRandomized, true
+	case "random-weighted":
+		return randomWeightedClientHelloID(), true
+	default:
+		return utls.ClientHelloID{}, false
+	}
+}
+
+func randomWeightedClientHelloID() utls.ClientHelloID {
+	total := 0
+	for _, wf := range weightedFingerprints {
+		total += wf.weight
+	}
+	n := rand.Intn(total)
+	for _, wf := range weightedFingerprints {
+		if n < wf.weight {
+			return wf.id
+		}
+		n -= wf.weight
+	}
+	return weightedFingerprints[0].id
+}
+
+// tlsClientHello performs a TLS handshake over conn, presenting the
+// ClientHello fingerprint requested by fingerprint ("go" by default).
+// serverName, when non-empty, is sent as SNI. The server's certificate is
+// not verified.
+func tlsClientHello(conn net.Conn, fingerprint string, serverName string) (net.Conn, error) {
+	return tlsClientHelloALPN(conn, fingerprint, serverName, nil)
+}
+
+// tlsClientHelloALPN is tlsClientHello with an explicit set of ALPN
+// protocols to advertise (OR'd into NextProtos), for the SNI/ALPN
+// pre-dispatch handshake in SimpleScanTargetContext.
+func tlsClientHelloALPN(conn net.Conn, fingerprint string, serverName string, nextProtos []string) (net.Conn, error) {
+	id, ok := clientHelloID(fingerprint)
+	if !ok {
+		config := tlsConfig.Clone()
+		if serverName != "" {
+			config.ServerName = serverName
+		}
+		config.NextProtos = nextProtos
+		stdConn := tls.Client(conn, config)
+		if err := stdConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake failed, err = %w", err)
+		}
+		return stdConn, nil
+	}
+
+	uConfig := &utls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+		ServerName:         serverName,
+		NextProtos:         nextProtos,
+	}
+	uConn := utls.UClient(conn, uConfig, id)
+	if err := uConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("utls handshake failed (fingerprint=%s), err = %w", fingerprint, err)
+	}
+	return uConn, nil
+}
+
+// tlsNegotiatedALPN returns the ALPN protocol negotiated on conn, if any.
+// conn must be a *tls.Conn or *utls.UConn, i.e. something returned by
+// tlsClientHello/tlsClientHelloALPN.
+func tlsNegotiatedALPN(conn net.Conn) string {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().NegotiatedProtocol
+	case *utls.UConn:
+		return c.ConnectionState().NegotiatedProtocol
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestClientHelloID(t *testing.T) {
+	tests := []struct {
+		fingerprint string
+		wantID      utls.ClientHelloID
+		wantOK      bool
+	}{
+		{"", utls.ClientHelloID{}, false},
+		{"go", utls.ClientHelloID{}, false},
+		{"Go", utls.ClientHelloID{}, false}, // case-insensitive
+		{"chrome", utls.HelloChrome_Auto, true},
+		{"CHROME", utls.HelloChrome_Auto, true},
+		{"firefox", utls.HelloFirefox_Auto, true},
+		{"safari", utls.HelloSafari_Auto, true},
+		{"ios", utls.HelloIOS_Auto, true},
+		{"randomized", utls.HelloRandomized, true},
+		{"bogus", utls.ClientHelloID{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fingerprint, func(t *testing.T) {
+			id, ok := clientHelloID(tt.fingerprint)
+			if ok != tt.wantOK {
+				t.Fatalf("clientHelloID(%q) ok = %v, want %v", tt.fingerprint, ok, tt.wantOK)
+			}
+			if ok && id != tt.wantID {
+				t.Errorf("clientHelloID(%q) = %v, want %v", tt.fingerprint, id, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestClientHelloIDRandomWeighted(t *testing.T) {
+	known := map[utls.ClientHelloID]bool{}
+	for _, wf := range weightedFingerprints {
+		known[wf.id] = true
+	}
+
+	for i := 0; i < 50; i++ {
+		id, ok := clientHelloID("random-weighted")
+		if !ok {
+			t.Fatalf("clientHelloID(%q) ok = false, want true", "random-weighted")
+		}
+		if !known[id] {
+			t.Errorf("clientHelloID(%q) = %v, not one of the weighted fingerprints", "random-weighted", id)
+		}
+	}
+}
+
+// closeTrackingConn wraps a net.Conn to record whether Close was called,
+// and fails every Read/Write so a TLS/uTLS handshake over it errors out
+// immediately instead of blocking.
+type closeTrackingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *closeTrackingConn) Read(b []byte) (int, error)  { return 0, net.ErrClosed }
+func (c *closeTrackingConn) Write(b []byte) (int, error) { return 0, net.ErrClosed }
+func (c *closeTrackingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *closeTrackingConn) wasClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestTLSClientHelloALPNClosesConnOnHandshakeFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint string
+	}{
+		{"stdlib crypto/tls", ""},
+		{"uTLS", "chrome"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &closeTrackingConn{}
+			_, err := tlsClientHelloALPN(conn, tt.fingerprint, "example.com", nil)
+			if err == nil {
+				t.Fatal("tlsClientHelloALPN() error = nil, want non-nil (handshake over a broken conn must fail)")
+			}
+			if !conn.wasClosed() {
+				t.Error("tlsClientHelloALPN() left conn open after a failed handshake, want it closed to avoid leaking the fd")
+			}
+		})
+	}
+}
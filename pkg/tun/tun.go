@@ -0,0 +1,324 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tun turns fingerprintx into a transparent, in-line protocol
+// identifier for a TUN interface: every TCP/UDP flow routed through the
+// device is forwarded to its real destination unmodified, and concurrently
+// fingerprinted as if it were an ordinary scan target.
+package tun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"github.com/praetorian-inc/fingerprintx/pkg/plugins"
+	"github.com/praetorian-inc/fingerprintx/pkg/scan"
+)
+
+const nicID tcpip.NICID = 1
+
+// peekBufLimit bounds how many bytes of a relayed flow are captured for
+// fingerprinting. Large enough for the initial banner/handshake most
+// plugins key off, small enough to keep memory bounded per flow.
+const peekBufLimit = 4096
+
+// defaultIdentifyCap bounds identifySem when config.MaxConcurrentPlugins is
+// unset, mirroring scan.Config's own default.
+const defaultIdentifyCap = 10
+
+// identifyQuiesceWindow is how long forward waits for peek to go quiet (no
+// new bytes) before treating a replay as complete. Multi-segment responses
+// (a TLS ServerHello+Certificate, a multi-line banner) can arrive as
+// several Writes; snapshotting on the very first one would truncate them.
+// Declared as a var, not a const, so tests can shrink it.
+var identifyQuiesceWindow = 150 * time.Millisecond
+
+// identifyPollInterval is how often forward checks peek for new bytes while
+// waiting for it to go quiet. Declared as a var, not a const, so tests can
+// shrink it.
+var identifyPollInterval = 10 * time.Millisecond
+
+// Ingress reads IP packets from a TUN device's file descriptor, reconstructs
+// TCP/UDP flows with a gvisor netstack, and for each one dials the flow's
+// real destination (through config's proxy settings; TLSFingerprint is not
+// used, since the flow's own bytes are relayed as they are) while
+// fingerprinting that same flow's traffic in place with the ordinary scan
+// plugins.
+type Ingress struct {
+	stack  *stack.Stack
+	config scan.Config
+
+	// identifySem bounds how many flows are fingerprinted concurrently, so a
+	// busy TUN can't run more plugin batteries at once than
+	// config.MaxConcurrentPlugins allows for an ordinary scan.
+	identifySem chan struct{}
+}
+
+// NewIngress builds a netstack-backed Ingress bound to fd, an already-open
+// TUN device (e.g. opened with IFF_TUN|IFF_NO_PI). mtu must match the
+// device's configured MTU.
+func NewIngress(fd int, mtu uint32, config scan.Config) (*Ingress, error) {
+	linkEP, err := fdbased.New(&fdbased.Options{
+		FDs: []int{fd},
+		MTU: mtu,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create tun link endpoint, err = %w", err)
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	if tcpErr := s.CreateNIC(nicID, linkEP); tcpErr != nil {
+		return nil, fmt.Errorf("unable to create nic, err = %v", tcpErr)
+	}
+	// Accept packets addressed to any destination (we're a router, not an
+	// endpoint) and let the stack pick the destination-specific route below.
+	s.SetPromiscuousMode(nicID, true)
+	s.SetSpoofing(nicID, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	identifyCap := config.MaxConcurrentPlugins
+	if identifyCap <= 0 {
+		identifyCap = defaultIdentifyCap
+	}
+	ingress := &Ingress{stack: s, config: config, identifySem: make(chan struct{}, identifyCap)}
+
+	tcpForwarder := tcp.NewForwarder(s, 0, 1024, ingress.handleTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(s, ingress.handleUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	return ingress, nil
+}
+
+// Close tears down the netstack and its TUN NIC.
+func (i *Ingress) Close() {
+	i.stack.Close()
+}
+
+func (i *Ingress) handleTCP(r *tcp.ForwarderRequest) {
+	target := plugins.Target{Address: flowAddr(r.ID())}
+
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	i.forward(gonet.NewTCPConn(&wq, ep), target, "tcp")
+}
+
+func (i *Ingress) handleUDP(r *udp.ForwarderRequest) {
+	target := plugins.Target{Address: flowAddr(r.ID())}
+
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		return
+	}
+
+	i.forward(gonet.NewUDPConn(&wq, ep), target, "udp")
+}
+
+// forward relays localConn to its real destination unmodified, and
+// fingerprints a replay of the remote side's response with the ordinary
+// scan plugins so live traffic gets identified in-line rather than routed
+// through a second, separately-dialed connection purely for fingerprinting.
+// The replay captures remote->local bytes, not local->remote, because
+// IdentifyData/IdentifyUDPData hand it to a plugin as the bytes read back
+// after the plugin's own (discarded) probe - i.e. it must look like the
+// server's response, not the client's request.
+func (i *Ingress) forward(localConn ingressConn, target plugins.Target, network string) {
+	defer localConn.Close()
+
+	remoteConn, err := i.config.DialTarget(context.Background(), network, target)
+	if err != nil {
+		return
+	}
+	defer remoteConn.Close()
+
+	peek := newPeekBuf()
+	flowDone := make(chan struct{})
+	go func() {
+		select {
+		case <-peek.ready:
+		case <-flowDone:
+			i.identify(peek.snapshot(), target, network)
+			return
+		}
+		i.identify(awaitQuiescence(peek, flowDone), target, network)
+	}()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remoteConn, localConn) //nolint:errcheck
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(io.MultiWriter(localConn, peek), remoteConn) //nolint:errcheck
+		done <- struct{}{}
+	}()
+	<-done
+	close(flowDone)
+}
+
+// identify runs the ordinary scan plugins against data, a captured replay of
+// bytes forward already relayed, instead of opening a second connection to
+// target purely to fingerprint it. Bounded by identifySem; a flow that
+// arrives while the semaphore is full is left unidentified rather than
+// queued, since by the time a slot freed up the replay would be stale.
+func (i *Ingress) identify(data []byte, target plugins.Target, network string) {
+	if len(data) == 0 {
+		return
+	}
+	select {
+	case i.identifySem <- struct{}{}:
+	default:
+		return
+	}
+	defer func() { <-i.identifySem }()
+
+	identify := i.config.IdentifyData
+	if network == "udp" {
+		identify = i.config.IdentifyUDPData
+	}
+
+	result, err := identify(data, target)
+	if err != nil {
+		if i.config.Verbose {
+			log.Printf("error: %v fingerprinting %v\n", err, target.Address.String())
+		}
+		return
+	}
+	if result != nil {
+		log.Printf("%v (%v/%v)\n", target.Address.String(), result.Transport, result.Protocol)
+	}
+}
+
+// ingressConn is the subset of net.Conn that gonet's TCP/UDP conn types
+// share and forward needs.
+type ingressConn interface {
+	io.ReadWriteCloser
+}
+
+// awaitQuiescence blocks until peek has gone identifyQuiesceWindow without
+// a new byte arriving, has filled up to peekBufLimit, or flowDone fires -
+// whichever comes first - then returns peek's snapshot. Called only after
+// peek.ready has already fired, i.e. at least one byte has arrived.
+func awaitQuiescence(peek *peekBuf, flowDone <-chan struct{}) []byte {
+	ticker := time.NewTicker(identifyPollInterval)
+	defer ticker.Stop()
+
+	lastLen := peek.len()
+	quietSince := time.Now()
+	for {
+		select {
+		case <-flowDone:
+			return peek.snapshot()
+		case <-ticker.C:
+			if n := peek.len(); n != lastLen {
+				lastLen = n
+				quietSince = time.Now()
+			}
+			if lastLen >= peekBufLimit || time.Since(quietSince) >= identifyQuiesceWindow {
+				return peek.snapshot()
+			}
+		}
+	}
+}
+
+// peekBuf captures up to peekBufLimit bytes written to it (forward tees the
+// remote->local direction of a flow into one via io.MultiWriter) and
+// signals ready the first time any bytes arrive, so forward can start
+// waiting for the reply to go quiet (see awaitQuiescence) instead of
+// blocking on the whole flow finishing.
+type peekBuf struct {
+	mu    sync.Mutex
+	buf   []byte
+	ready chan struct{}
+	once  sync.Once
+}
+
+func newPeekBuf() *peekBuf {
+	return &peekBuf{ready: make(chan struct{})}
+}
+
+func (p *peekBuf) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	if room := peekBufLimit - len(p.buf); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		p.buf = append(p.buf, b[:room]...)
+	}
+	p.mu.Unlock()
+	p.once.Do(func() { close(p.ready) })
+	return len(b), nil
+}
+
+func (p *peekBuf) snapshot() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]byte, len(p.buf))
+	copy(out, p.buf)
+	return out
+}
+
+// len returns how many bytes have been captured so far.
+func (p *peekBuf) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.buf)
+}
+
+// flowAddr extracts the flow's original destination as a netip.AddrPort.
+func flowAddr(id stack.TransportEndpointID) netip.AddrPort {
+	return netip.AddrPortFrom(tcpipToNetipAddr(id.LocalAddress), id.LocalPort)
+}
+
+func tcpipToNetipAddr(addr tcpip.Address) netip.Addr {
+	if addr.Len() == 4 {
+		var b [4]byte
+		copy(b[:], addr.AsSlice())
+		return netip.AddrFrom4(b)
+	}
+	var b [16]byte
+	copy(b[:], addr.AsSlice())
+	return netip.AddrFrom16(b)
+}
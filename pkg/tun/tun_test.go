@@ -0,0 +1,166 @@
+// Copyright 2022 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestTcpipToNetipAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr tcpip.Address
+		want netip.Addr
+	}{
+		{
+			name: "ipv4",
+			addr: tcpip.AddrFromSlice([]byte{192, 0, 2, 1}),
+			want: netip.AddrFrom4([4]byte{192, 0, 2, 1}),
+		},
+		{
+			name: "ipv6",
+			addr: tcpip.AddrFromSlice([]byte{0x20, 0x01, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}),
+			want: netip.AddrFrom16([16]byte{0x20, 0x01, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tcpipToNetipAddr(tt.addr); got != tt.want {
+				t.Errorf("tcpipToNetipAddr(%v) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlowAddr(t *testing.T) {
+	id := stack.TransportEndpointID{
+		LocalPort:    443,
+		LocalAddress: tcpip.AddrFromSlice([]byte{192, 0, 2, 1}),
+	}
+	want := netip.MustParseAddrPort("192.0.2.1:443")
+	if got := flowAddr(id); got != want {
+		t.Errorf("flowAddr(%v) = %v, want %v", id, got, want)
+	}
+}
+
+func TestPeekBufCapturesUpToLimit(t *testing.T) {
+	p := newPeekBuf()
+
+	if _, err := p.Write(bytes.Repeat([]byte{'a'}, peekBufLimit-1)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	select {
+	case <-p.ready:
+	default:
+		t.Fatal("ready not closed after first write")
+	}
+
+	if _, err := p.Write([]byte("bb")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	got := p.snapshot()
+	if len(got) != peekBufLimit {
+		t.Fatalf("snapshot() length = %d, want %d", len(got), peekBufLimit)
+	}
+	if got[peekBufLimit-1] != 'b' {
+		t.Errorf("snapshot()[last] = %q, want 'b' (only one byte of the second write should have fit)", got[peekBufLimit-1])
+	}
+}
+
+func TestPeekBufWriteNeverFails(t *testing.T) {
+	p := newPeekBuf()
+	n, err := p.Write(bytes.Repeat([]byte{'a'}, peekBufLimit*2))
+	if err != nil {
+		t.Fatalf("Write() error = %v, want nil", err)
+	}
+	if n != peekBufLimit*2 {
+		t.Errorf("Write() n = %d, want %d (io.Writer contract: report all bytes consumed)", n, peekBufLimit*2)
+	}
+	if len(p.snapshot()) != peekBufLimit {
+		t.Errorf("snapshot() length = %d, want capped at %d", len(p.snapshot()), peekBufLimit)
+	}
+}
+
+// withShortQuiescenceWindows shrinks identifyQuiesceWindow/identifyPollInterval
+// for the duration of a test, so awaitQuiescence tests don't need to wait
+// out the real (production-sized) window.
+func withShortQuiescenceWindows(t *testing.T) {
+	t.Helper()
+	oldWindow, oldPoll := identifyQuiesceWindow, identifyPollInterval
+	identifyQuiesceWindow = 40 * time.Millisecond
+	identifyPollInterval = 5 * time.Millisecond
+	t.Cleanup(func() {
+		identifyQuiesceWindow, identifyPollInterval = oldWindow, oldPoll
+	})
+}
+
+func TestAwaitQuiescenceWaitsOutTrailingWrites(t *testing.T) {
+	withShortQuiescenceWindows(t)
+
+	p := newPeekBuf()
+	flowDone := make(chan struct{})
+	p.Write([]byte("HTTP/1.1 200")) //nolint:errcheck
+
+	go func() {
+		// A second segment of the same response, arriving after peek.ready
+		// has already fired but before the quiescence window elapses.
+		time.Sleep(identifyQuiesceWindow / 2)
+		p.Write([]byte(" OK\r\n")) //nolint:errcheck
+	}()
+
+	got := awaitQuiescence(p, flowDone)
+	want := "HTTP/1.1 200 OK\r\n"
+	if string(got) != want {
+		t.Errorf("awaitQuiescence() = %q, want %q (trailing write arrived before quiescence, should be included)", got, want)
+	}
+}
+
+func TestAwaitQuiescenceReturnsOnFlowDone(t *testing.T) {
+	withShortQuiescenceWindows(t)
+
+	p := newPeekBuf()
+	p.Write([]byte("partial")) //nolint:errcheck
+	flowDone := make(chan struct{})
+	close(flowDone)
+
+	got := awaitQuiescence(p, flowDone)
+	if string(got) != "partial" {
+		t.Errorf("awaitQuiescence() = %q, want %q", got, "partial")
+	}
+}
+
+func TestAwaitQuiescenceStopsAtBufLimit(t *testing.T) {
+	withShortQuiescenceWindows(t)
+
+	p := newPeekBuf()
+	flowDone := make(chan struct{})
+	p.Write(bytes.Repeat([]byte{'a'}, peekBufLimit)) //nolint:errcheck
+
+	start := time.Now()
+	got := awaitQuiescence(p, flowDone)
+	if elapsed := time.Since(start); elapsed >= identifyQuiesceWindow {
+		t.Errorf("awaitQuiescence() took %v, want it to return as soon as peek hit peekBufLimit instead of waiting out the quiescence window", elapsed)
+	}
+	if len(got) != peekBufLimit {
+		t.Errorf("awaitQuiescence() returned %d bytes, want %d", len(got), peekBufLimit)
+	}
+}